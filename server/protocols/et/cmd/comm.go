@@ -9,9 +9,60 @@
 
 package cmd
 
-import "github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/comm"
+import (
+	"sync"
+
+	"github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/comm"
+	"github.com/eaglexiang/go/logger"
+)
+
+// RelayerAddrForDomain 按目标域名选出应使用的relayer地址
+// cmd包本身不知道relayer池的存在：它由eagletunnel.Init在启动时注入一个函数值，
+// 而不是直接import eagletunnel，避免两个包互相import造成循环依赖。
+// 未注入（如未启用多relayer，或单元测试环境）时sendQuery退化为原来的行为
+//
+// NOT YET WIRED INTO THE REAL DIAL: comm.SendQueryReq/comm.Connect2Remote only
+// dial the one fixed remote address they already hold internally — neither
+// accepts a per-request address. Until that lands upstream, the pick made here
+// is only observable via SelectedRelayerAddr(), not actually dispatched to.
+// TODO(eagletunnel): once comm.SendQueryReq/Connect2Remote can dial a given
+// address, feed selectedRelayerAddr into that call and drop relayerDispatchWarnOnce
+var RelayerAddrForDomain func(domain string) (addr string, err error)
+
+// MultiRelayerPoolActive 报告relayer池当前是否配置了一个以上的relayer
+// 由eagletunnel.Init注入，sendQuery用它判断relayerDispatchWarnOnce该不该响——
+// 绝大多数部署只配置单个relayer，从不关心按域名分发，不该被这条警告打扰
+var MultiRelayerPoolActive func() bool
+
+var selectedRelayerMu sync.RWMutex
+var selectedRelayerAddr string
+var relayerDispatchWarnOnce sync.Once
+
+// SelectedRelayerAddr 返回最近一次sendQuery按域名选出的relayer地址
+// comm.SendQueryReq/comm.Connect2Remote目前仍然只认一个全局的拨号目标，
+// 还不会读取这个值；它在这里是为了让RelayerAddrForDomain的选择结果
+// 至少在cmd包内可观测、可测试，而不是选完就被丢弃
+func SelectedRelayerAddr() string {
+	selectedRelayerMu.RLock()
+	defer selectedRelayerMu.RUnlock()
+	return selectedRelayerAddr
+}
 
 func sendQuery(s comm.Sender, req string) (string, error) {
+	if RelayerAddrForDomain != nil {
+		if addr, err := RelayerAddrForDomain(req); err == nil {
+			selectedRelayerMu.Lock()
+			selectedRelayerAddr = addr
+			selectedRelayerMu.Unlock()
+			if MultiRelayerPoolActive != nil && MultiRelayerPoolActive() {
+				relayerDispatchWarnOnce.Do(func() {
+					logger.Warning("relayer pool picked ", addr, " for outbound dispatch, ",
+						"but comm.SendQueryReq/Connect2Remote cannot yet dial a specific ",
+						"relayer address; still falling back to the single configured remote")
+				})
+			}
+		}
+	}
 	req = s.Name() + " " + req
 	return comm.SendQueryReq(req)
 }
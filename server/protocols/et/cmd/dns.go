@@ -10,33 +10,181 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/comm"
 	cache "github.com/eaglexiang/go/cache/text"
 	"github.com/eaglexiang/go/logger"
 	"github.com/eaglexiang/go/tunnel"
+	"golang.org/x/sync/singleflight"
 )
 
+// defaultTTL 解析器未携带TTL信息时使用的缓存时长
+const defaultTTL = 5 * time.Minute
+
+// negativeTTL 负缓存（AD hosts / NXDOMAIN）的有效期
+// 有意选得比defaultTTL短很多，避免一个暂时性的解析失败被记太久
+const negativeTTL = 30 * time.Second
+
 // ErrADHostsFound 发现广告 hosts
 var ErrADHostsFound = errors.New("ad hosts found")
 
 // ErrInvalidProxyStatus 非法的 proxy-status
 var ErrInvalidProxyStatus = errors.New("invalid proxy-status")
 
+// ErrNXDomain 上游没有返回可用的解析结果
+var ErrNXDomain = errors.New("nxdomain: no valid reply from upstream")
+
+// ProxyStatusProvider 取得当前生效的proxy-status，Send()据此判断走智能/强制代理模式
+// 由eagletunnel.Init在启动时注入，写法与RelayerAddrForDomain相同：cmd包本身不知道
+// SIGHUP热重载的存在，也不直接import eagletunnel以避免循环依赖。
+// 未注入（如单元测试环境）时退化为comm.DefaultArg.ProxyStatus
+var ProxyStatusProvider func() int
+
+// WhitelistDomainsProvider 取得当前生效的强制代理域名列表，smartSend用它判断一个
+// 不确定类型的域名是否应该强制走代理（而不必等离线GeoSite库命中）。
+// 同样由eagletunnel.Init注入；未注入时白名单检查被跳过，退化为只看GeoSite分类
+var WhitelistDomainsProvider func() []string
+
+// inWhitelist 判断domain是否命中WhitelistDomainsProvider给出的强制代理域名列表
+// 匹配规则与geoSiteClassifier.Classify一致：精确匹配或作为某条目的子域名
+func inWhitelist(domain string) bool {
+	if WhitelistDomainsProvider == nil {
+		return false
+	}
+	for _, suffix := range WhitelistDomainsProvider() {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 // DNS ET-DNS子协议的实现
 type DNS struct {
 	sync.Mutex
 	DNSType        comm.CMDType
 	dnsRemoteCache *cache.TextCache
 	dnsLocalCache  *cache.TextCache
-	DNSResolver    func(string) (string, error) `label:"DNS解析器"`
+	DNSResolver    Resolver `label:"DNS解析器"`
+
+	ttlMutex sync.Mutex
+	expires  map[string]time.Time
+
+	// localGroup/remoteGroup 把同一个domain的并发查询合并成一次实际的解析调用
+	localGroup  singleflight.Group
+	remoteGroup singleflight.Group
+
+	negMutex sync.Mutex
+	negative map[string]negEntry
+}
+
+// negEntry 负缓存条目：记住一次失败结果及其过期时间
+type negEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeError 查询domain是否命中未过期的负缓存
+func (d *DNS) negativeError(domain string) (err error, ok bool) {
+	d.negMutex.Lock()
+	defer d.negMutex.Unlock()
+	entry, found := d.negative[domain]
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(d.negative, domain)
+		return nil, false
+	}
+	return entry.err, true
+}
+
+// setNegative 记录一次值得负缓存的失败结果
+func (d *DNS) setNegative(domain string, err error) {
+	d.negMutex.Lock()
+	defer d.negMutex.Unlock()
+	if d.negative == nil {
+		d.negative = make(map[string]negEntry)
+	}
+	d.negative[domain] = negEntry{err: err, expires: time.Now().Add(negativeTTL)}
+}
+
+// clearNegative 解析成功后清掉domain可能残留的负缓存
+func (d *DNS) clearNegative(domain string) {
+	d.negMutex.Lock()
+	defer d.negMutex.Unlock()
+	delete(d.negative, domain)
+}
+
+// isNegativeCacheable 判断一个解析失败是否值得记入负缓存
+// 只缓存明确的"解析不到"类错误，网络抖动等瞬时错误不缓存，以免延误恢复
+func isNegativeCacheable(err error) bool {
+	return err == ErrADHostsFound || err == ErrNXDomain
+}
+
+// SetDNSResolverFunc 以旧式的 func(string) (string, error) 设置解析器
+// 保留此方法是为了兼容历史调用方式，此时缓存条目使用 defaultTTL 而非应答中的真实TTL
+func (d *DNS) SetDNSResolverFunc(f func(string) (string, error)) {
+	d.DNSResolver = funcResolver(f)
+}
+
+// NewDNS 构造一个ET-DNS子协议实例
+// resolver可以是实现了Resolver接口的值（如NewResolver/ConfigureResolver返回的DoH/DoT/UDP解析器），
+// 也可以是旧式的 func(string) (string, error)，后者会被自动适配为funcResolver，
+// 传nil则回退到ConfigureResolversFromConfig/dns-local配置出的默认解析器（仍未配置时DNSResolver留空，
+// 沿用历史上必须手动赋值DNSResolver才能解析本地域名的行为）。
+// 这是从"cmd.DNS{DNSResolver: someFunc, DNSType: ...}"这种历史构造方式迁移过来的推荐写法，
+// 因为DNSResolver字段本身是Resolver接口，裸func字面量不再满足它
+func NewDNS(dnsType comm.CMDType, resolver interface{}) (*DNS, error) {
+	d := &DNS{DNSType: dnsType}
+	switch r := resolver.(type) {
+	case nil:
+		d.DNSResolver = DefaultLocalResolver()
+	case Resolver:
+		d.DNSResolver = r
+	case func(string) (string, error):
+		d.DNSResolver = funcResolver(r)
+	default:
+		return nil, fmt.Errorf("cmd: unsupported resolver type %T", resolver)
+	}
+	return d, nil
+}
+
+func (d *DNS) expireAt(domain string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	d.ttlMutex.Lock()
+	if d.expires == nil {
+		d.expires = make(map[string]time.Time)
+	}
+	d.expires[domain] = time.Now().Add(ttl)
+	d.ttlMutex.Unlock()
+}
+
+// expired 判断domain对应的缓存是否已经过了应答携带的真实TTL
+func (d *DNS) expired(domain string) bool {
+	d.ttlMutex.Lock()
+	defer d.ttlMutex.Unlock()
+	if d.expires == nil {
+		return false
+	}
+	deadline, ok := d.expires[domain]
+	if !ok {
+		return false
+	}
+	return time.Now().After(deadline)
 }
 
 // Handle 处理ET-DNS请求
 func (d *DNS) Handle(req string, t *tunnel.Tunnel) (err error) {
+	defer trackActiveTunnel()()
+
 	reqs := strings.Split(req, " ")
 	if len(reqs) < 2 {
 		return errors.New("ETDNS.Handle -> req is too short")
@@ -58,9 +206,11 @@ func (d *DNS) look4Hosts(domain string) (ip string, ok bool, err error) {
 		return
 	}
 	logger.Info("hosts found: ", domain, " ", ip)
+	hostsCacheHitTotal.Inc()
 
 	if ip == "::" {
 		err = ErrADHostsFound
+		adBlockHitTotal.Inc()
 		logger.Info("ad hosts found: ", domain)
 	}
 	return
@@ -79,7 +229,11 @@ func (d *DNS) Send(e *comm.NetArg) (err error) {
 		return
 	}
 
-	switch comm.DefaultArg.ProxyStatus {
+	proxyStatus := comm.DefaultArg.ProxyStatus
+	if ProxyStatusProvider != nil {
+		proxyStatus = ProxyStatusProvider()
+	}
+	switch proxyStatus {
 	case comm.ProxySMART:
 		err = d.smartSend(e)
 	case comm.ProxyENABLE:
@@ -93,10 +247,31 @@ func (d *DNS) Send(e *comm.NetArg) (err error) {
 }
 
 // smartSend 智能模式
-// 智能模式会先检查域名是否存在于明确域名列表
-// 列表内域名将根据明确规则进行解析
+// 智能模式会先检查域名是否存在于whitelist_domain.txt（容易被污染、需要强制代理的域名），
+// 命中的域名按ProxyDomain处理；不在白名单里时，再查一次离线GeoSite分类库，
+// 命中cn/private等类目的按DirectDomain处理，命中ads的直接拒绝
 func (d *DNS) smartSend(e *comm.NetArg) (err error) {
-	switch e.DomainType {
+	domainType := e.DomainType
+	if domainType == comm.UncertainDomain && inWhitelist(e.Domain) {
+		logger.Info("whitelist domain found, force proxy: ", e.Domain)
+		domainType = comm.ProxyDomain
+	}
+	if domainType == comm.UncertainDomain {
+		if cat, ok := geoSiteDB.Classify(e.Domain); ok {
+			switch cat {
+			case "ads":
+				logger.Info("geosite ad domain found: ", e.Domain)
+				adBlockHitTotal.Inc()
+				return ErrADHostsFound
+			case "cn", "private":
+				domainType = comm.DirectDomain
+			default:
+				domainType = comm.ProxyDomain
+			}
+		}
+	}
+
+	switch domainType {
 	case comm.DirectDomain:
 		logger.Info("resolv direct domain: ", e.Domain)
 		err = d.resolvDNSByLocal(e)
@@ -112,8 +287,18 @@ func (d *DNS) smartSend(e *comm.NetArg) (err error) {
 
 func (d *DNS) resolvDNSByLocation(e *comm.NetArg) (err error) {
 	err = d.resolvDNSByLocal(e)
-	// 判断IP所在位置是否适合代理
-	comm.SubSenders[comm.LOCATION].Send(e)
+	if err != nil {
+		return err
+	}
+
+	// 优先使用本地GeoIP库离线判断IP所在地区，命中库时不需要再发起远程位置查询
+	country, geoErr := geoIPDB.Country(e.IP)
+	if geoErr == nil && country != "" {
+		e.Location = country
+	} else {
+		comm.SubSenders[comm.LOCATION].Send(e)
+	}
+
 	if !checkProxyByLocation(e.Location) {
 		return nil
 	}
@@ -148,7 +333,13 @@ func (d *DNS) getCacheNodeOfRemote(domain string) (node *cache.CacheNode, loaded
 		}
 		d.Unlock()
 	}
-	return d.dnsRemoteCache.Get(domain)
+	node, loaded = d.dnsRemoteCache.Get(domain)
+	if loaded && d.expired(domain) {
+		node.Destroy()
+		node, loaded = d.dnsRemoteCache.Get(domain)
+	}
+	observeCacheResult("remote", loaded)
+	return
 }
 
 func (d *DNS) getCacheNodeOfLocal(domain string) (node *cache.CacheNode, loaded bool) {
@@ -160,67 +351,144 @@ func (d *DNS) getCacheNodeOfLocal(domain string) (node *cache.CacheNode, loaded
 		}
 		d.Unlock()
 	}
-	return d.dnsLocalCache.Get(domain)
+	node, loaded = d.dnsLocalCache.Get(domain)
+	if loaded && d.expired(domain) {
+		node.Destroy()
+		node, loaded = d.dnsLocalCache.Get(domain)
+	}
+	observeCacheResult("local", loaded)
+	return
 }
 
 // resolvDNSByProxy 使用代理服务器进行DNS的解析
-// 此函数主要完成缓存功能
-// 当缓存不命中则调用 DNS._resolvDNSByProxy
+// 此函数主要完成缓存功能：命中负缓存直接返回历史错误；
+// 其余情况下由remoteGroup把同一domain的并发请求合并为一次 DNS._resolvDNSByProxy 调用
 func (d *DNS) resolvDNSByProxy(e *comm.NetArg) (err error) {
-	node, loaded := d.getCacheNodeOfRemote(e.Domain)
-	if loaded {
-		logger.Info("wait for proxy cachenode")
-		e.IP, err = node.Wait()
-	} else {
-		err = d._resolvDNSByProxy(e)
-		if err != nil {
+	if negErr, ok := d.negativeError(e.Domain); ok {
+		return negErr
+	}
+
+	v, err, _ := d.remoteGroup.Do(e.Domain, func() (interface{}, error) {
+		node, loaded := d.getCacheNodeOfRemote(e.Domain)
+		if loaded {
+			logger.Info("wait for proxy cachenode")
+			return node.Wait()
+		}
+		inner := &comm.NetArg{NetConnArg: comm.NetConnArg{Domain: e.Domain}}
+		resolveErr := d._resolvDNSByProxy(inner)
+		if resolveErr != nil {
 			node.Destroy()
-		} else {
-			node.Update(e.IP)
+			return "", resolveErr
+		}
+		node.Update(inner.IP)
+		return inner.IP, nil
+	})
+
+	if err != nil {
+		if isNegativeCacheable(err) {
+			d.setNegative(e.Domain, err)
 		}
+		return err
 	}
-	return err
+	d.clearNegative(e.Domain)
+	e.IP = v.(string)
+	return nil
 }
 
 // _resolvDNSByProxy 使用代理服务器进行DNS的解析
-// 实际完成DNS查询操作
+// 实际完成DNS查询操作：优先用dns-proxy配置出的Resolver（DefaultProxyResolver）
+// 直接解析，这样可以免去一次ET协议往返；未配置dns-proxy时退化为经sendQuery
+// 向relay发起ET-DNS查询的历史行为
 func (d *DNS) _resolvDNSByProxy(e *comm.NetArg) (err error) {
-	e.IP, err = sendQuery(d, e.Domain)
-	ip := net.ParseIP(e.IP)
-	if ip == nil {
-		logger.Warning("fail to resolv dns by proxy: ", e.Domain, " -> ", e.IP)
-		return errors.New("invalid reply")
+	if r := DefaultProxyResolver(); r != nil {
+		return timeResolve("proxy", func() error {
+			var ttl time.Duration
+			var resolveErr error
+			e.IP, ttl, resolveErr = r.Resolve(e.Domain)
+			if resolveErr != nil {
+				logger.Warning("fail to resolv dns by proxy (transport): ", e.Domain, " -> ", resolveErr)
+				return resolveErr
+			}
+			if net.ParseIP(e.IP) == nil {
+				logger.Warning("fail to resolv dns by proxy: ", e.Domain, " -> ", e.IP)
+				return ErrNXDomain
+			}
+			d.expireAt(e.Domain, ttl)
+			return nil
+		})
 	}
-	return nil
+	return timeResolve("proxy", func() error {
+		reply, sendErr := sendQuery(d, e.Domain)
+		if sendErr != nil {
+			// relay不可达/连接中断等传输层错误，不代表这个域名解析不到，不应进负缓存
+			logger.Warning("fail to resolv dns by proxy (transport): ", e.Domain, " -> ", sendErr)
+			return sendErr
+		}
+		e.IP = reply
+		if net.ParseIP(e.IP) == nil {
+			logger.Warning("fail to resolv dns by proxy: ", e.Domain, " -> ", e.IP)
+			return ErrNXDomain
+		}
+		// relay端不会随结果一起下发TTL，退化为 defaultTTL
+		d.expireAt(e.Domain, defaultTTL)
+		return nil
+	})
 }
 
 // resolvDNSByLocal 本地解析DNS
-// 此函数主要完成缓存功能
-// 当缓存不命中则进一步调用 DNS._resolvDNSByLocalClient
+// 此函数主要完成缓存功能：命中负缓存直接返回历史错误；
+// 其余情况下由localGroup把同一domain的并发请求合并为一次 DNS._resolvDNSByLocalClient 调用
 func (d *DNS) resolvDNSByLocal(e *comm.NetArg) (err error) {
-	node, loaded := d.getCacheNodeOfLocal(e.Domain)
-	if loaded {
-		e.IP, err = node.Wait()
-	} else {
-		err = d._resolvDNSByLocal(e)
-		if err != nil {
+	if negErr, ok := d.negativeError(e.Domain); ok {
+		return negErr
+	}
+
+	v, err, _ := d.localGroup.Do(e.Domain, func() (interface{}, error) {
+		node, loaded := d.getCacheNodeOfLocal(e.Domain)
+		if loaded {
+			return node.Wait()
+		}
+		inner := &comm.NetArg{NetConnArg: comm.NetConnArg{Domain: e.Domain}}
+		resolveErr := d._resolvDNSByLocal(inner)
+		if resolveErr != nil {
 			node.Destroy()
-		} else {
-			node.Update(e.IP)
+			return "", resolveErr
 		}
+		node.Update(inner.IP)
+		return inner.IP, nil
+	})
+
+	if err != nil {
+		if isNegativeCacheable(err) {
+			d.setNegative(e.Domain, err)
+		}
+		return err
 	}
-	return err
+	d.clearNegative(e.Domain)
+	e.IP = v.(string)
+	return nil
 }
 
 // _resolvDNSByLocalClient 本地解析DNS
 // 实际完成DNS的解析动作
 func (d *DNS) _resolvDNSByLocal(e *comm.NetArg) (err error) {
-	e.IP, err = d.DNSResolver(e.Domain)
-	// 本地解析失败应该让用户察觉，手动添加DNS白名单
-	if err != nil {
-		logger.Warning("fail to resolv dns by local, ",
-			"consider adding this domain to your whitelist_domain.txt: ",
-			e.Domain)
-	}
-	return err
+	return timeResolve("local", func() error {
+		var ttl time.Duration
+		var resolveErr error
+		e.IP, ttl, resolveErr = d.DNSResolver.Resolve(e.Domain)
+		if resolveErr != nil {
+			// 上游明确给出NXDOMAIN/空应答，这种情况下一步才值得进负缓存
+			if resolveErr == errNoAnswer {
+				logger.Warning("fail to resolv dns by local, ",
+					"consider adding this domain to your whitelist_domain.txt: ",
+					e.Domain)
+				return ErrNXDomain
+			}
+			// 拨号/超时等传输层错误只是瞬时的，不应该被当成"解析不到"缓存下来
+			logger.Warning("fail to resolv dns by local (transport): ", e.Domain, " -> ", resolveErr)
+			return resolveErr
+		}
+		d.expireAt(e.Domain, ttl)
+		return nil
+	})
 }
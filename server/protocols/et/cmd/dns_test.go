@@ -0,0 +1,99 @@
+/*
+ * @Author: EagleXiang
+ * @Github: https://github.com/eaglexiang
+ */
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/comm"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInWhitelist(t *testing.T) {
+	defer func() { WhitelistDomainsProvider = nil }()
+
+	WhitelistDomainsProvider = func() []string {
+		return []string{"example.com"}
+	}
+
+	if !inWhitelist("example.com") {
+		t.Fatal("exact match: expected example.com to be in whitelist")
+	}
+	if !inWhitelist("sub.example.com") {
+		t.Fatal("suffix match: expected sub.example.com to be in whitelist")
+	}
+	if inWhitelist("notexample.com") {
+		t.Fatal("unrelated domain sharing a suffix string should not match")
+	}
+	if inWhitelist("unrelated.org") {
+		t.Fatal("domain not in whitelist should not match")
+	}
+}
+
+func TestInWhitelistNoProvider(t *testing.T) {
+	WhitelistDomainsProvider = nil
+	if inWhitelist("example.com") {
+		t.Fatal("inWhitelist should be false when WhitelistDomainsProvider is unset")
+	}
+}
+
+// fakeResolver lets tests stand in for a configured dns-proxy resolver
+// without dialing anything real.
+type fakeResolver struct {
+	ip  string
+	ttl time.Duration
+	err error
+}
+
+func (f fakeResolver) Resolve(domain string) (string, time.Duration, error) {
+	return f.ip, f.ttl, f.err
+}
+
+func TestSmartSendCountsGeositeAdsAsAdBlockHit(t *testing.T) {
+	geoSiteDB.mu.Lock()
+	oldRules := geoSiteDB.rules
+	geoSiteDB.rules = map[string][]string{"ads": {"ad.example.com"}}
+	geoSiteDB.mu.Unlock()
+	defer func() {
+		geoSiteDB.mu.Lock()
+		geoSiteDB.rules = oldRules
+		geoSiteDB.mu.Unlock()
+	}()
+
+	before := testutil.ToFloat64(adBlockHitTotal)
+
+	d := &DNS{}
+	e := &comm.NetArg{NetConnArg: comm.NetConnArg{Domain: "ad.example.com"}, DomainType: comm.UncertainDomain}
+	if err := d.smartSend(e); err != ErrADHostsFound {
+		t.Fatalf("smartSend: expected ErrADHostsFound, got %v", err)
+	}
+
+	if after := testutil.ToFloat64(adBlockHitTotal); after != before+1 {
+		t.Fatalf("adBlockHitTotal: expected %v, got %v", before+1, after)
+	}
+}
+
+func TestResolvDNSByProxyUsesDefaultProxyResolverWhenConfigured(t *testing.T) {
+	defer func() {
+		defaultResolverMu.Lock()
+		defaultProxyResolver = nil
+		defaultResolverMu.Unlock()
+	}()
+
+	defaultResolverMu.Lock()
+	defaultProxyResolver = fakeResolver{ip: "1.2.3.4", ttl: time.Minute}
+	defaultResolverMu.Unlock()
+
+	d := &DNS{DNSType: comm.DNS}
+	e := &comm.NetArg{NetConnArg: comm.NetConnArg{Domain: "example.com"}}
+	if err := d._resolvDNSByProxy(e); err != nil {
+		t.Fatalf("_resolvDNSByProxy: unexpected error %v", err)
+	}
+	if e.IP != "1.2.3.4" {
+		t.Fatalf("_resolvDNSByProxy: got IP %q, want 1.2.3.4", e.IP)
+	}
+}
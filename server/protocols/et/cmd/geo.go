@@ -0,0 +1,196 @@
+/*
+ * @Author: EagleXiang
+ * @Github: https://github.com/eaglexiang
+ * @Date: 2019-09-23 10:05:00
+ * @LastEditors: EagleXiang
+ * @LastEditTime: 2019-09-23 10:05:00
+ */
+
+package cmd
+
+import (
+	"encoding/gob"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPDB 进程内唯一的GeoIP2/GeoLite2数据库实例
+// resolvDNSByLocation 用它在本地判断IP所在地区，避免每次查询都走一次远程Sender
+var geoIPDB = &geoIPResolver{}
+
+// geoSiteDB 进程内唯一的GeoSite域名分类器实例
+var geoSiteDB = &geoSiteClassifier{}
+
+// geoIPResolver 对mmdb格式的GeoIP2/GeoLite2数据库的封装
+// 数据库以lazy-mmap方式打开，查询不需要把整个文件读进内存
+type geoIPResolver struct {
+	mu sync.RWMutex
+	db *maxminddb.Reader
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// ConfigureGeoFromConfig 读取 geoip-db / geosite-db 两个配置键并据此加载对应数据库
+// 这是Init阶段真正应该调用的入口：两个键都是可选的，缺失时对应的库保持未加载状态，
+// resolvDNSByLocation/smartSend会照常退化到原来的远程/静态规则判断
+func ConfigureGeoFromConfig(keyValues map[string]string) error {
+	if path, ok := keyValues["geoip-db"]; ok && path != "" {
+		if err := ConfigureGeoIP(path); err != nil {
+			return err
+		}
+	}
+	if path, ok := keyValues["geosite-db"]; ok && path != "" {
+		if err := ConfigureGeoSite(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigureGeoIP 加载GeoIP2/GeoLite2数据库文件
+// 对应配置文件里的 geoip-db=<path> 键，由调用方在Init阶段读取配置后调用
+func ConfigureGeoIP(path string) error {
+	return geoIPDB.reload(path)
+}
+
+func (g *geoIPResolver) reload(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Reload 热切换到一份新的GeoIP数据库，原数据库在替换后关闭
+// 供运营人员轮换数据库文件时调用，不需要重启进程
+func (g *geoIPResolver) Reload(path string) error {
+	return g.reload(path)
+}
+
+// Country 查询ip所属的国家/地区代码，数据库未加载时返回空字符串
+func (g *geoIPResolver) Country(ip string) (string, error) {
+	g.mu.RLock()
+	db := g.db
+	g.mu.RUnlock()
+	if db == nil {
+		return "", nil
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", errInvalidIP
+	}
+
+	var record geoIPRecord
+	if err := db.Lookup(parsed, &record); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(record.Country.ISOCode), nil
+}
+
+var errInvalidIP = newGeoError("invalid ip for geoip lookup")
+
+func newGeoError(msg string) error { return &geoError{msg} }
+
+type geoError struct{ msg string }
+
+func (e *geoError) Error() string { return e.msg }
+
+// geoSiteClassifier 基于离线编译的规则集，把域名归类到cn/ads/private等类目
+// 规则集以encoding/gob编码，内容是 类目 -> 域名后缀列表 的映射，
+// 由配套的离线编译工具从GeoSite风格的规则源生成
+type geoSiteClassifier struct {
+	mu    sync.RWMutex
+	rules map[string][]string // category -> domain suffixes
+}
+
+// ConfigureGeoSite 加载编译好的GeoSite规则集文件
+// 对应配置文件里的 geosite-db=<path> 键
+func ConfigureGeoSite(path string) error {
+	return geoSiteDB.reload(path)
+}
+
+func (c *geoSiteClassifier) reload(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules := make(map[string][]string)
+	if err := gob.NewDecoder(f).Decode(&rules); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.rules = rules
+	c.mu.Unlock()
+	return nil
+}
+
+// Reload 热切换到一份新编译的规则集
+func (c *geoSiteClassifier) Reload(path string) error {
+	return c.reload(path)
+}
+
+// geoSiteCategoryPriority 固定的类目优先级：一个域名的后缀同时落在多个类目里时
+// （规则集本身允许重叠），按这个顺序决定先报哪个。ads排最前是因为smartSend拿到
+// "ads"会直接拒绝解析，这条规则不应该被其他类目抢先命中而失效
+var geoSiteCategoryPriority = []string{"ads", "cn", "private"}
+
+// Classify 返回domain命中的第一个类目，未命中任何规则时ok为false
+// 先按geoSiteCategoryPriority里固定的顺序检查已知类目，再按字典序检查规则集里
+// 其余未被收录进优先级表的类目，这样同一个domain在多次调用之间返回的结果是
+// 确定的——直接对c.rules这个map做range，iteration顺序是随机的，会让命中多个
+// 类目的域名在不同进程/不同次调用间得到不同结果
+func (c *geoSiteClassifier) Classify(domain string) (category string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	matches := func(suffixes []string) bool {
+		for _, suffix := range suffixes {
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := make(map[string]bool, len(geoSiteCategoryPriority))
+	for _, cat := range geoSiteCategoryPriority {
+		seen[cat] = true
+		if matches(c.rules[cat]) {
+			return cat, true
+		}
+	}
+
+	var rest []string
+	for cat := range c.rules {
+		if !seen[cat] {
+			rest = append(rest, cat)
+		}
+	}
+	sort.Strings(rest)
+	for _, cat := range rest {
+		if matches(c.rules[cat]) {
+			return cat, true
+		}
+	}
+	return "", false
+}
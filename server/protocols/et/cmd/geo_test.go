@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestGeoSiteClassify(t *testing.T) {
+	c := &geoSiteClassifier{rules: map[string][]string{
+		"cn":  {"cn-site.com"},
+		"ads": {"ads-network.com"},
+	}}
+
+	if cat, ok := c.Classify("cn-site.com"); !ok || cat != "cn" {
+		t.Fatalf("exact match: got (%q, %v), want (cn, true)", cat, ok)
+	}
+	if cat, ok := c.Classify("sub.cn-site.com"); !ok || cat != "cn" {
+		t.Fatalf("suffix match: got (%q, %v), want (cn, true)", cat, ok)
+	}
+	if cat, ok := c.Classify("notcn-site.com"); ok {
+		t.Fatalf("unrelated domain sharing a suffix string should not match, got (%q, %v)", cat, ok)
+	}
+	if _, ok := c.Classify("unknown.org"); ok {
+		t.Fatal("unknown domain should not match any category")
+	}
+}
+
+func TestGeoSiteClassifyOverlappingCategoriesIsDeterministic(t *testing.T) {
+	c := &geoSiteClassifier{rules: map[string][]string{
+		"cn":      {"overlap.com"},
+		"ads":     {"overlap.com"},
+		"private": {"overlap.com"},
+	}}
+
+	for i := 0; i < 20; i++ {
+		cat, ok := c.Classify("overlap.com")
+		if !ok || cat != "ads" {
+			t.Fatalf("run %d: got (%q, %v), want (ads, true) every time", i, cat, ok)
+		}
+	}
+}
+
+func TestGeoSiteClassifyUnknownCategoryFallsBackToSortedOrder(t *testing.T) {
+	c := &geoSiteClassifier{rules: map[string][]string{
+		"zzz": {"overlap.org"},
+		"aaa": {"overlap.org"},
+	}}
+
+	for i := 0; i < 20; i++ {
+		cat, ok := c.Classify("overlap.org")
+		if !ok || cat != "aaa" {
+			t.Fatalf("run %d: got (%q, %v), want (aaa, true) every time", i, cat, ok)
+		}
+	}
+}
+
+func TestGeoIPResolverCountryWithoutLoadedDB(t *testing.T) {
+	g := &geoIPResolver{}
+	country, err := g.Country("8.8.8.8")
+	if err != nil {
+		t.Fatalf("Country: unexpected error with no db loaded: %v", err)
+	}
+	if country != "" {
+		t.Fatalf("Country: got %q, want empty string with no db loaded", country)
+	}
+}
+
+func TestGeoIPResolverCountryInvalidIP(t *testing.T) {
+	g := &geoIPResolver{}
+	g.db = &maxminddb.Reader{}
+
+	if _, err := g.Country("not-an-ip"); err != errInvalidIP {
+		t.Fatalf("Country: got err %v, want errInvalidIP", err)
+	}
+}
+
+func TestGeoIPResolverReloadBadPathLeavesExistingDBIntact(t *testing.T) {
+	g := &geoIPResolver{}
+	existing := &maxminddb.Reader{}
+	g.db = existing
+
+	if err := g.reload(filepath.Join(t.TempDir(), "does-not-exist.mmdb")); err == nil {
+		t.Fatal("reload: expected an error for a nonexistent path")
+	}
+	if g.db != existing {
+		t.Fatal("reload: a failed reload must not replace the already-loaded db")
+	}
+}
+
+func TestConfigureGeoFromConfigMissingKeysIsNoop(t *testing.T) {
+	if err := ConfigureGeoFromConfig(map[string]string{}); err != nil {
+		t.Fatalf("ConfigureGeoFromConfig with no keys should be a no-op, got error: %v", err)
+	}
+}
+
+func TestConfigureGeoFromConfigLoadsGeoSite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "geosite.dat")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create fixture file: %v", err)
+	}
+	rules := map[string][]string{"cn": {"example.cn"}}
+	if err := gob.NewEncoder(f).Encode(rules); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	f.Close()
+
+	if err := ConfigureGeoFromConfig(map[string]string{"geosite-db": path}); err != nil {
+		t.Fatalf("ConfigureGeoFromConfig: unexpected error %v", err)
+	}
+	if cat, ok := geoSiteDB.Classify("example.cn"); !ok || cat != "cn" {
+		t.Fatalf("geoSiteDB.Classify(\"example.cn\") = (%q, %v), want (cn, true)", cat, ok)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * @Author: EagleXiang
+ * @Github: https://github.com/eaglexiang
+ * @Date: 2019-09-24 09:40:00
+ * @LastEditors: EagleXiang
+ * @LastEditTime: 2019-09-24 09:40:00
+ */
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dnsCacheTotal 按cache（local/remote）和result（hit/miss）统计DNS缓存命中情况
+var dnsCacheTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "eagletunnel_dns_cache_total",
+		Help: "count of DNS cache lookups by cache layer and hit/miss result",
+	},
+	[]string{"cache", "result"},
+)
+
+// dnsResolverLatency 按protocol（local/proxy）统计一次解析耗时的分布
+var dnsResolverLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "eagletunnel_dns_resolver_latency_seconds",
+		Help:    "latency of a single upstream DNS resolution",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"protocol"},
+)
+
+// hostsCacheHitTotal hosts表命中次数
+var hostsCacheHitTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "eagletunnel_hosts_cache_hit_total",
+		Help: "count of domains resolved directly from the hosts cache",
+	},
+)
+
+// adBlockHitTotal 命中广告hosts（ErrADHostsFound）的次数
+var adBlockHitTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "eagletunnel_ad_block_hit_total",
+		Help: "count of lookups rejected because the domain is AD-blocked",
+	},
+)
+
+// activeTunnels 当前正在处理中的ET子协议请求数，每个Handle调用对应一条tunnel
+var activeTunnels = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "eagletunnel_active_tunnels",
+		Help: "number of ET sub-protocol requests (tunnels) currently being handled",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(dnsCacheTotal, dnsResolverLatency, hostsCacheHitTotal, adBlockHitTotal, activeTunnels)
+}
+
+// trackActiveTunnel 标记一条tunnel开始被处理，返回的函数在处理结束时调用以标记结束
+// 典型用法是在Handle的开头defer trackActiveTunnel()()
+func trackActiveTunnel() func() {
+	activeTunnels.Inc()
+	return activeTunnels.Dec
+}
+
+func observeCacheResult(cache string, loaded bool) {
+	result := "miss"
+	if loaded {
+		result = "hit"
+	}
+	dnsCacheTotal.WithLabelValues(cache, result).Inc()
+}
+
+// timeResolve 对f计时并上报到dnsResolverLatency，protocol区分是local解析还是走relay代理解析
+func timeResolve(protocol string, f func() error) error {
+	start := time.Now()
+	err := f()
+	dnsResolverLatency.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+	return err
+}
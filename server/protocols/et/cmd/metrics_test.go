@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTrackActiveTunnel(t *testing.T) {
+	if got := testutil.ToFloat64(activeTunnels); got != 0 {
+		t.Fatalf("activeTunnels: expected 0 before tracking, got %v", got)
+	}
+
+	done := trackActiveTunnel()
+	if got := testutil.ToFloat64(activeTunnels); got != 1 {
+		t.Fatalf("activeTunnels: expected 1 while handling, got %v", got)
+	}
+
+	done()
+	if got := testutil.ToFloat64(activeTunnels); got != 0 {
+		t.Fatalf("activeTunnels: expected 0 after handling, got %v", got)
+	}
+}
@@ -0,0 +1,352 @@
+/*
+ * @Author: EagleXiang
+ * @Github: https://github.com/eaglexiang
+ * @Date: 2019-09-22 09:10:00
+ * @LastEditors: EagleXiang
+ * @LastEditTime: 2019-09-22 09:10:00
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errNoAnswer 应答报文本身是合法的，但上游明确表示查不到该域名（NXDOMAIN或没有A记录）
+// 与拨号/读写超时等传输层错误不同，这类错误才值得进负缓存
+var errNoAnswer = errors.New("resolver: no usable answer in reply")
+
+// Resolver 统一的DNS解析器接口
+// 除了返回解析到的IP，还会返回应答中携带的TTL，
+// 以便调用方对缓存条目设置真实的过期时间
+type Resolver interface {
+	Resolve(domain string) (ip string, ttl time.Duration, err error)
+}
+
+// funcResolver 把旧式的 func(string) (string, error) 适配为 Resolver
+// 用于兼容历史上直接赋值 DNSResolver 字段的用法，此时TTL恒为0（永不过期）
+type funcResolver func(string) (string, error)
+
+func (f funcResolver) Resolve(domain string) (ip string, ttl time.Duration, err error) {
+	ip, err = f(domain)
+	return
+}
+
+// NewResolver 根据URI构造对应协议的Resolver
+// 支持的scheme:
+//
+//	udp://host:port  传统明文查询（默认端口53）
+//	tls://host:port  DNS-over-TLS，RFC 7858（默认端口853）
+//	https://host/path DNS-over-HTTPS，RFC 8484
+func NewResolver(uri string) (Resolver, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("resolver: invalid uri %s", uri)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return newDoHResolver(uri), nil
+	case "tls":
+		return newDoTResolver(defaultPort(u.Host, "853")), nil
+	case "udp":
+		return newUDPResolver(defaultPort(u.Host, "53")), nil
+	default:
+		return nil, fmt.Errorf("resolver: unsupported scheme %s", u.Scheme)
+	}
+}
+
+// ConfigureResolver 是dns-local/dns-proxy配置值的真正入口
+// 配置文件里的取值既可以写成URI（udp://223.5.5.5:53、tls://8.8.8.8:853、
+// https://1.1.1.1/dns-query），也可以沿用旧式的纯"host:port"地址，
+// 后者等价于udp://host:port。调用方（加载dns-local/dns-proxy配置的那一层）
+// 应该用本函数代替直接调用NewResolver，以保持两种写法都能解析
+func ConfigureResolver(value string) (Resolver, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("resolver: empty config value")
+	}
+	if isURIResolver(value) {
+		return NewResolver(value)
+	}
+	return NewResolver("udp://" + value)
+}
+
+var defaultResolverMu sync.RWMutex
+var defaultLocalResolver Resolver
+var defaultProxyResolver Resolver
+
+// ConfigureResolversFromConfig 读取 dns-local / dns-proxy 两个配置键并据此构造解析器
+// 这是Init阶段真正应该调用的入口：两个键都是可选的，缺失时对应角色保持原有行为
+// （dns-local缺省时沿用DNS.DNSResolver手动设置的值，dns-proxy缺省时沿用sendQuery经relay解析）
+func ConfigureResolversFromConfig(keyValues map[string]string) error {
+	if value, ok := keyValues["dns-local"]; ok && value != "" {
+		resolver, err := ConfigureResolver(value)
+		if err != nil {
+			return err
+		}
+		defaultResolverMu.Lock()
+		defaultLocalResolver = resolver
+		defaultResolverMu.Unlock()
+	}
+	if value, ok := keyValues["dns-proxy"]; ok && value != "" {
+		resolver, err := ConfigureResolver(value)
+		if err != nil {
+			return err
+		}
+		defaultResolverMu.Lock()
+		defaultProxyResolver = resolver
+		defaultResolverMu.Unlock()
+	}
+	return nil
+}
+
+// DefaultLocalResolver 返回dns-local配置出的解析器，未配置时返回nil
+// 构造DNS实例（NewDNS）处理直连域名时应优先使用它
+func DefaultLocalResolver() Resolver {
+	defaultResolverMu.RLock()
+	defer defaultResolverMu.RUnlock()
+	return defaultLocalResolver
+}
+
+// DefaultProxyResolver 返回dns-proxy配置出的解析器，未配置时返回nil
+// DNS._resolvDNSByProxy优先用它代替经sendQuery向relay发起ET-DNS查询，
+// 省去一次ET协议往返；未配置dns-proxy时_resolvDNSByProxy退化为原来的sendQuery路径
+func DefaultProxyResolver() Resolver {
+	defaultResolverMu.RLock()
+	defer defaultResolverMu.RUnlock()
+	return defaultProxyResolver
+}
+
+func defaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// buildQuery 构造一条标准的A记录查询报文
+func buildQuery(domain string) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(time.Now().UnixNano())
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+	buf, err := msg.Pack()
+	return buf, id, err
+}
+
+// parseReply 从DNS应答报文中取出第一条A记录及其TTL
+func parseReply(reply []byte, wantID uint16) (ip string, ttl time.Duration, err error) {
+	var msg dnsmessage.Message
+	if err = msg.Unpack(reply); err != nil {
+		return
+	}
+	if msg.Header.ID != wantID {
+		err = fmt.Errorf("resolver: mismatched reply id")
+		return
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		err = errNoAnswer
+		return
+	}
+	for _, a := range msg.Answers {
+		if a.Header.Type != dnsmessage.TypeA {
+			continue
+		}
+		r, ok := a.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		ip = net.IP(r.A[:]).String()
+		ttl = time.Duration(a.Header.TTL) * time.Second
+		return
+	}
+	err = errNoAnswer
+	return
+}
+
+// udpResolver 传统明文UDP查询
+type udpResolver struct {
+	addr string
+}
+
+func newUDPResolver(addr string) *udpResolver {
+	return &udpResolver{addr: addr}
+}
+
+func (r *udpResolver) Resolve(domain string) (ip string, ttl time.Duration, err error) {
+	query, id, err := buildQuery(domain)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialTimeout("udp", r.addr, 5*time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	return parseReply(buf[:n], id)
+}
+
+// dotResolver DNS-over-TLS (RFC 7858) 解析器
+// 内部维护一个到同一地址的TLS连接池，以复用握手的开销
+type dotResolver struct {
+	addr string
+	pool chan *tls.Conn
+}
+
+func newDoTResolver(addr string) *dotResolver {
+	return &dotResolver{
+		addr: addr,
+		pool: make(chan *tls.Conn, 8),
+	}
+}
+
+func (r *dotResolver) getConn() (*tls.Conn, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	default:
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", r.addr, &tls.Config{})
+}
+
+func (r *dotResolver) putConn(conn *tls.Conn) {
+	select {
+	case r.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (r *dotResolver) Resolve(domain string) (ip string, ttl time.Duration, err error) {
+	query, id, err := buildQuery(domain)
+	if err != nil {
+		return
+	}
+
+	conn, err := r.getConn()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			return
+		}
+		r.putConn(conn)
+	}()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// DoT在TCP上传输，报文前需加2字节长度前缀
+	prefixed := make([]byte, 2+len(query))
+	prefixed[0] = byte(len(query) >> 8)
+	prefixed[1] = byte(len(query))
+	copy(prefixed[2:], query)
+	if _, err = conn.Write(prefixed); err != nil {
+		return
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err = ioReadFull(conn, lenBuf); err != nil {
+		return
+	}
+	replyLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+	reply := make([]byte, replyLen)
+	if _, err = ioReadFull(conn, reply); err != nil {
+		return
+	}
+	return parseReply(reply, id)
+}
+
+func ioReadFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// dohResolver DNS-over-HTTPS (RFC 8484) 解析器
+// 复用同一个 http.Client，使底层 HTTP/2 连接得以在多次查询间保持并复用
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDoHResolver(endpoint string) *dohResolver {
+	return &dohResolver{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (r *dohResolver) Resolve(domain string) (ip string, ttl time.Duration, err error) {
+	query, id, err := buildQuery(domain)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("resolver: doh status %s", resp.Status)
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	return parseReply(body, id)
+}
+
+// isURIResolver 粗略判断一个配置值是否写成URI形式（而非旧式的纯地址）
+func isURIResolver(value string) bool {
+	return strings.Contains(value, "://")
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/comm"
+)
+
+func TestNewResolverSchemeDispatch(t *testing.T) {
+	cases := []struct {
+		uri     string
+		wantErr bool
+	}{
+		{"udp://223.5.5.5:53", false},
+		{"udp://223.5.5.5", false},
+		{"tls://8.8.8.8:853", false},
+		{"tls://8.8.8.8", false},
+		{"https://1.1.1.1/dns-query", false},
+		{"ftp://1.1.1.1", true},
+		{"not-a-uri", true},
+		{"", true},
+	}
+	for _, c := range cases {
+		r, err := NewResolver(c.uri)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("NewResolver(%q): expected error, got nil", c.uri)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewResolver(%q): unexpected error %v", c.uri, err)
+			continue
+		}
+		if r == nil {
+			t.Errorf("NewResolver(%q): got nil resolver with no error", c.uri)
+		}
+	}
+}
+
+func TestConfigureResolverAcceptsLegacyAddr(t *testing.T) {
+	r, err := ConfigureResolver("223.5.5.5:53")
+	if err != nil {
+		t.Fatalf("ConfigureResolver: unexpected error %v", err)
+	}
+	if _, ok := r.(*udpResolver); !ok {
+		t.Fatalf("ConfigureResolver: expected *udpResolver for legacy addr, got %T", r)
+	}
+}
+
+func TestConfigureResolverAcceptsURI(t *testing.T) {
+	r, err := ConfigureResolver("tls://8.8.8.8:853")
+	if err != nil {
+		t.Fatalf("ConfigureResolver: unexpected error %v", err)
+	}
+	if _, ok := r.(*dotResolver); !ok {
+		t.Fatalf("ConfigureResolver: expected *dotResolver for tls:// uri, got %T", r)
+	}
+}
+
+func TestConfigureResolverRejectsEmpty(t *testing.T) {
+	if _, err := ConfigureResolver(""); err == nil {
+		t.Fatal("ConfigureResolver(\"\"): expected error, got nil")
+	}
+}
+
+func TestConfigureResolversFromConfig(t *testing.T) {
+	defer func() {
+		defaultResolverMu.Lock()
+		defaultLocalResolver = nil
+		defaultProxyResolver = nil
+		defaultResolverMu.Unlock()
+	}()
+
+	err := ConfigureResolversFromConfig(map[string]string{
+		"dns-local": "udp://223.5.5.5:53",
+		"dns-proxy": "tls://8.8.8.8:853",
+	})
+	if err != nil {
+		t.Fatalf("ConfigureResolversFromConfig: unexpected error %v", err)
+	}
+
+	if _, ok := DefaultLocalResolver().(*udpResolver); !ok {
+		t.Fatalf("DefaultLocalResolver: expected *udpResolver, got %T", DefaultLocalResolver())
+	}
+	if _, ok := DefaultProxyResolver().(*dotResolver); !ok {
+		t.Fatalf("DefaultProxyResolver: expected *dotResolver, got %T", DefaultProxyResolver())
+	}
+
+	d, err := NewDNS(comm.DNS, nil)
+	if err != nil {
+		t.Fatalf("NewDNS: unexpected error %v", err)
+	}
+	if d.DNSResolver != DefaultLocalResolver() {
+		t.Fatal("NewDNS(dnsType, nil): expected DNSResolver to fall back to DefaultLocalResolver")
+	}
+}
+
+func TestConfigureResolversFromConfigMissingKeysNoop(t *testing.T) {
+	defer func() {
+		defaultResolverMu.Lock()
+		defaultLocalResolver = nil
+		defaultProxyResolver = nil
+		defaultResolverMu.Unlock()
+	}()
+
+	if err := ConfigureResolversFromConfig(map[string]string{}); err != nil {
+		t.Fatalf("ConfigureResolversFromConfig: unexpected error %v", err)
+	}
+	if DefaultLocalResolver() != nil || DefaultProxyResolver() != nil {
+		t.Fatal("ConfigureResolversFromConfig: expected resolvers to stay unset without dns-local/dns-proxy")
+	}
+}
@@ -0,0 +1,247 @@
+package eagletunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// errUnknownConfigFormat 配置文件的扩展名既不是.yaml/.yml也不是.json
+var errUnknownConfigFormat = errors.New("eagletunnel: unrecognized config file extension, expected .yaml/.yml/.json")
+
+// RawConfig 结构化（YAML/JSON）配置文件对应的schema
+// 字段含义与传统的key=value配置一一对应，是迁移到新格式时的直接映射
+type RawConfig struct {
+	ConfigDir     string   `yaml:"config-dir" json:"config-dir"`
+	UserCheck     bool     `yaml:"user-check" json:"user-check"`
+	User          string   `yaml:"user" json:"user"`
+	DataKey       string   `yaml:"data-key" json:"data-key"`
+	Listen        string   `yaml:"listen" json:"listen"`
+	SOCKS5        bool     `yaml:"socks" json:"socks"`
+	HTTP          bool     `yaml:"http" json:"http"`
+	ET            bool     `yaml:"et" json:"et"`
+	Relayers      []string `yaml:"relayers" json:"relayers"`
+	ProxyStatus   string   `yaml:"proxy-status" json:"proxy-status"`
+	HostsFeeds    []string `yaml:"hosts-feed" json:"hosts-feed"`
+	HostsRefresh  string   `yaml:"hosts-refresh" json:"hosts-refresh"`
+	DNSLocal      string   `yaml:"dns-local" json:"dns-local"`
+	DNSProxy      string   `yaml:"dns-proxy" json:"dns-proxy"`
+	GeoIPDB       string   `yaml:"geoip-db" json:"geoip-db"`
+	GeoSiteDB     string   `yaml:"geosite-db" json:"geosite-db"`
+	MetricsListen string   `yaml:"metrics-listen" json:"metrics-listen"`
+	Pprof         bool     `yaml:"pprof" json:"pprof"`
+}
+
+// isStructuredConfig 根据扩展名判断配置文件是否为YAML/JSON格式
+func isStructuredConfig(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadStructuredConfig 加载并校验一份YAML/JSON配置
+func loadStructuredConfig(path string) (*RawConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &RawConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".json":
+		err = json.Unmarshal(data, cfg)
+	default:
+		return nil, errUnknownConfigFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *RawConfig) validate() error {
+	switch c.ProxyStatus {
+	case "", "enable", "smart":
+	default:
+		return fmt.Errorf("eagletunnel: invalid proxy-status %q", c.ProxyStatus)
+	}
+	return nil
+}
+
+// toKeyValues 把RawConfig翻译为旧式的ConfigKeyValues
+// 这是保持向后兼容的shim：Init()剩余的初始化逻辑完全复用，
+// 不需要关心配置到底来自.conf还是YAML/JSON
+func (c *RawConfig) toKeyValues() map[string]string {
+	kv := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			kv[key] = value
+		}
+	}
+	set("config-dir", c.ConfigDir)
+	set("user", c.User)
+	set("data-key", c.DataKey)
+	set("listen", c.Listen)
+	set("proxy-status", c.ProxyStatus)
+	if c.UserCheck {
+		kv["user-check"] = "on"
+	}
+	if c.SOCKS5 {
+		kv["socks"] = "on"
+	}
+	if c.HTTP {
+		kv["http"] = "on"
+	}
+	if c.ET {
+		kv["et"] = "on"
+	}
+	if len(c.Relayers) > 0 {
+		kv["relayers"] = strings.Join(c.Relayers, ",")
+	}
+	if len(c.HostsFeeds) > 0 {
+		kv["hosts-feed"] = strings.Join(c.HostsFeeds, ",")
+	}
+	set("hosts-refresh", c.HostsRefresh)
+	set("dns-local", c.DNSLocal)
+	set("dns-proxy", c.DNSProxy)
+	set("geoip-db", c.GeoIPDB)
+	set("geosite-db", c.GeoSiteDB)
+	set("metrics-listen", c.MetricsListen)
+	if c.Pprof {
+		kv["pprof"] = "on"
+	}
+	return kv
+}
+
+// MutableConfig 可以被SIGHUP热重载的那部分配置
+// Handle/Send等请求处理路径应通过CurrentConfig()取得一份快照，
+// 重载发生时只是原子地替换指针，已经持有旧快照的请求会完整地跑完
+type MutableConfig struct {
+	ProxyStatus      int
+	WhitelistDomains []string
+	HostsCache       map[string]string
+	RelayerAddrs     []string
+}
+
+var currentConfig atomic.Value // *MutableConfig
+
+// CurrentConfig 原子地取得当前生效的可变配置快照
+func CurrentConfig() *MutableConfig {
+	cfg, _ := currentConfig.Load().(*MutableConfig)
+	return cfg
+}
+
+// CurrentProxyStatus 返回当前生效的ProxyStatus
+// 经由CurrentConfig()的原子快照读取。Init()把它注入cmd.ProxyStatusProvider，
+// 这样cmd.DNS.Send在决定智能/强制代理模式时读到的是热重载后的最新值，
+// 而不是Init()跑过一次就再也不会更新的包级ProxyStatus变量
+func CurrentProxyStatus() int {
+	if cfg := CurrentConfig(); cfg != nil {
+		return cfg.ProxyStatus
+	}
+	return ProxyStatus
+}
+
+// CurrentWhitelistDomains 返回当前生效的白名单域名列表，语义同CurrentProxyStatus
+// Init()把它注入cmd.WhitelistDomainsProvider，供cmd.DNS.smartSend判断
+// 不确定类型的域名是否应该强制走代理
+func CurrentWhitelistDomains() []string {
+	if cfg := CurrentConfig(); cfg != nil {
+		return cfg.WhitelistDomains
+	}
+	return WhitelistDomains
+}
+
+func storeCurrentConfig(cfg *MutableConfig) {
+	currentConfig.Store(cfg)
+}
+
+// WatchReload 监听SIGHUP信号，热重载ProxyStatus、白名单域名、hosts和relayer池成员
+// 每次重载都是读取ConfigPath后原子替换MutableConfig指针，不影响正在进行的请求
+func WatchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := reloadMutableConfig(); err != nil {
+			fmt.Println("failed to reload config: ", err)
+			continue
+		}
+		fmt.Println("config reloaded")
+	}
+}
+
+func reloadMutableConfig() error {
+	cfg, err := buildMutableConfig(ConfigPath, ConfigDir)
+	if err != nil {
+		return err
+	}
+	storeCurrentConfig(cfg)
+
+	// ProxyStatus/白名单域名不再直接改写包级变量：它们已经随cfg存入了上面的
+	// currentConfig快照，cmd.DNS.Send/smartSend经由Init()注入的
+	// cmd.ProxyStatusProvider/cmd.WhitelistDomainsProvider读取这份快照，
+	// 这样SIGHUP goroutine和正在处理的请求之间不会出现数据竞争。
+	// 这里只需要应用剩下那部分真正需要主动"生效"一次的状态：hosts和relayer池成员
+	mergeHostsCache(cfg.HostsCache)
+
+	switch len(cfg.RelayerAddrs) {
+	case 0:
+	case 1:
+		SetRelayer(cfg.RelayerAddrs[0])
+	default:
+		SetRelayers(cfg.RelayerAddrs)
+	}
+	return nil
+}
+
+func buildMutableConfig(configPath, configDir string) (*MutableConfig, error) {
+	proxyStatus := ProxyENABLE
+	var relayerAddrs []string
+
+	if isStructuredConfig(configPath) {
+		cfg, err := loadStructuredConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.ProxyStatus == "smart" {
+			proxyStatus = ProxySMART
+		}
+		relayerAddrs = cfg.Relayers
+	} else {
+		allConfLines, err := readLines(configPath)
+		if err != nil {
+			return nil, err
+		}
+		keyValues, _ := getKeyValues(allConfLines)
+		if keyValues["proxy-status"] == "smart" {
+			proxyStatus = ProxySMART
+		}
+		relayerAddrs = collectRelayerAddrs(allConfLines, keyValues)
+	}
+
+	whitelistDomains, _ := readLines(configDir + "/whitelist_domain.txt")
+
+	return &MutableConfig{
+		ProxyStatus:      proxyStatus,
+		WhitelistDomains: whitelistDomains,
+		HostsCache:       loadHostsFiles(configDir),
+		RelayerAddrs:     relayerAddrs,
+	}, nil
+}
@@ -0,0 +1,67 @@
+package eagletunnel
+
+import "testing"
+
+func TestRawConfigValidate(t *testing.T) {
+	cases := []struct {
+		name       string
+		proxyState string
+		wantErr    bool
+	}{
+		{"empty defaults to enable", "", false},
+		{"enable", "enable", false},
+		{"smart", "smart", false},
+		{"unknown value", "bogus", true},
+	}
+	for _, c := range cases {
+		cfg := &RawConfig{ProxyStatus: c.proxyState}
+		err := cfg.validate()
+		if c.wantErr && err == nil {
+			t.Errorf("%s: expected error, got nil", c.name)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+}
+
+func TestRawConfigToKeyValuesCoversFullConfigSurface(t *testing.T) {
+	cfg := &RawConfig{
+		DNSLocal:      "udp://223.5.5.5:53",
+		DNSProxy:      "https://1.1.1.1/dns-query",
+		GeoIPDB:       "/etc/et/GeoLite2-Country.mmdb",
+		GeoSiteDB:     "/etc/et/geosite.dat",
+		MetricsListen: "0.0.0.0:9090",
+		Pprof:         true,
+	}
+	kv := cfg.toKeyValues()
+
+	want := map[string]string{
+		"dns-local":      "udp://223.5.5.5:53",
+		"dns-proxy":      "https://1.1.1.1/dns-query",
+		"geoip-db":       "/etc/et/GeoLite2-Country.mmdb",
+		"geosite-db":     "/etc/et/geosite.dat",
+		"metrics-listen": "0.0.0.0:9090",
+		"pprof":          "on",
+	}
+	for key, value := range want {
+		if got := kv[key]; got != value {
+			t.Errorf("toKeyValues()[%q] = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestIsStructuredConfig(t *testing.T) {
+	cases := map[string]bool{
+		"/etc/et/config.yaml": true,
+		"/etc/et/config.yml":  true,
+		"/etc/et/config.json": true,
+		"/etc/et/config.conf": false,
+		"/etc/et/config":      false,
+	}
+	for path, want := range cases {
+		if got := isStructuredConfig(path); got != want {
+			t.Errorf("isStructuredConfig(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
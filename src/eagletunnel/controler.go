@@ -8,6 +8,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/eaglexiang/eagle.tunnel.go/server/protocols/et/cmd"
 )
 
 // ConfigPath 主配置文件的路径
@@ -34,15 +37,95 @@ var EnableET bool
 // ProxyStatus 代理的状态（全局/智能）
 var ProxyStatus int
 
+// relayersMu 保护Relayers的读写
+// replaceRelayerPool在SIGHUP热重载时写入，RelayerAddrFor和metrics_server.go的
+// exportRelayerStats在各自的goroutine里读取，不加锁就是一处数据竞争
+var relayersMu sync.RWMutex
+
+// Relayers 当前使用的relayer池，按目标域名的一致性哈希分发请求
+// 仅配置了一个relayer时池内也只有一个节点，行为与旧版等价
+// 不要在别处直接读写这个变量，读用CurrentRelayerPool，写用replaceRelayerPool
+var Relayers *RelayerPool
+
+// CurrentRelayerPool 并发安全地取得当前生效的relayer池，可能为nil
+func CurrentRelayerPool() *RelayerPool {
+	relayersMu.RLock()
+	defer relayersMu.RUnlock()
+	return Relayers
+}
+
+// MultiRelayerPoolActive 报告当前是否配置了一个以上的relayer
+// 注入给cmd.MultiRelayerPoolActive，供sendQuery判断是否该提醒用户
+// "relayer池选出的地址目前还没有真正参与出站拨号"——单relayer部署
+// 从不启用按域名分发，不该看到这条噪音
+func MultiRelayerPoolActive() bool {
+	pool := CurrentRelayerPool()
+	return pool != nil && pool.Size() > 1
+}
+
+// remoteAddrMu 保护RemoteAddr/RemotePort的读写
+// 这两个变量原本只在Init/SIGHUP重载时被同步写入一次，现在syncActiveRelayerAddr
+// 还会从relayer池的健康检查goroutine里异步写它们，读写都必须经由
+// currentRemoteAddr/setRelayerAddr，不能再直接拼接包级变量
+var remoteAddrMu sync.RWMutex
+
+// currentRemoteAddr 并发安全地取得当前的RemoteAddr:RemotePort
+func currentRemoteAddr() string {
+	remoteAddrMu.RLock()
+	defer remoteAddrMu.RUnlock()
+	return RemoteAddr + ":" + RemotePort
+}
+
+// syncActiveRelayerAddr 把RemoteAddr/RemotePort同步为relayer池内按配置顺序
+// 第一个仍然存活的地址。SetRelayer(s)把它注册为池的健康变化回调，这样"第一个
+// relayer挂了"时，依赖RemoteAddr/RemotePort这两个历史包级变量的调用方
+// （包括comm包还不支持按域名拨号时RelayerAddrFor退化走的那条路径）会真正
+// failover到池里下一个存活节点，而不是继续对着一个已经连续探测失败的地址重试
+func syncActiveRelayerAddr() {
+	pool := CurrentRelayerPool()
+	if pool == nil {
+		return
+	}
+	addr, ok := pool.ActiveAddr()
+	if !ok {
+		return
+	}
+	host, port := splitHostPort(addr)
+	remoteAddrMu.Lock()
+	RemoteAddr = host
+	RemotePort = port
+	remoteAddrMu.Unlock()
+}
+
 // Init 根据给定的配置文件初始化参数
+// 配置文件既可以是传统的key=value格式（.conf），
+// 也可以是结构化的YAML/JSON格式，由扩展名自动识别；
+// 后者在加载时做一次性的schema校验，并通过shim翻译成同一套ConfigKeyValues，
+// 因此后续的初始化逻辑无需区分来源
 func Init(filePath string) error {
 	ConfigPath = filePath
-	allConfLines, err := readLines(ConfigPath)
-	if err != nil {
-		fmt.Println("failed to read " + ConfigPath)
+
+	var allConfLines []string
+	var err error
+	var keyValues map[string]string
+
+	if isStructuredConfig(ConfigPath) {
+		var cfg *RawConfig
+		cfg, err = loadStructuredConfig(ConfigPath)
+		if err != nil {
+			fmt.Println("failed to read " + ConfigPath)
+		} else {
+			keyValues = cfg.toKeyValues()
+		}
+	} else {
+		allConfLines, err = readLines(ConfigPath)
+		if err != nil {
+			fmt.Println("failed to read " + ConfigPath)
+		}
+		keyValues, _ = getKeyValues(allConfLines)
 	}
 
-	ConfigKeyValues, _ := getKeyValues(allConfLines)
+	ConfigKeyValues = keyValues
 
 	var ok bool
 
@@ -116,13 +199,24 @@ func Init(filePath string) error {
 	}
 
 	if EnableSOCKS5 || EnableHTTP {
-		var remoteIpe string
-		remoteIpe, ok = ConfigKeyValues["relayer"]
-		if ok {
-			SetRelayer(remoteIpe)
+		relayerAddrs := collectRelayerAddrs(allConfLines, ConfigKeyValues)
+		if len(relayerAddrs) == 1 {
+			SetRelayer(relayerAddrs[0])
+		} else if len(relayerAddrs) > 1 {
+			SetRelayers(relayerAddrs)
 		}
 	}
 
+	// 让cmd.sendQuery能够按域名选relayer，而不必直接import eagletunnel（会成环）
+	cmd.RelayerAddrForDomain = RelayerAddrFor
+
+	// 同理，让cmd.DNS.Send/smartSend读取到CurrentProxyStatus/CurrentWhitelistDomains
+	// 的原子快照，而不是Init()跑过一次就再也不会更新的包级变量，
+	// 这样SIGHUP热重载才能真正影响到正在处理的ET-DNS请求
+	cmd.ProxyStatusProvider = CurrentProxyStatus
+	cmd.WhitelistDomainsProvider = CurrentWhitelistDomains
+	cmd.MultiRelayerPoolActive = MultiRelayerPoolActive
+
 	ProxyStatus = ProxyENABLE
 	var status string
 	status, ok = ConfigKeyValues["proxy-status"]
@@ -140,8 +234,34 @@ func Init(filePath string) error {
 	whiteDomainsPath := ConfigDir + "/whitelist_domain.txt"
 	WhitelistDomains, _ = readLines(whiteDomainsPath)
 
+	err = cmd.ConfigureGeoFromConfig(ConfigKeyValues)
+	if err != nil {
+		fmt.Println("failed to load geoip-db/geosite-db: ", err)
+	}
+
+	err = cmd.ConfigureResolversFromConfig(ConfigKeyValues)
+	if err != nil {
+		fmt.Println("failed to load dns-local/dns-proxy resolver: ", err)
+	}
+
 	readHosts(ConfigDir)
 
+	hostsFeeds := collectHostsFeeds(allConfLines, ConfigKeyValues)
+	hostsRefresh := parseHostsRefresh(ConfigKeyValues["hosts-refresh"])
+	StartHostsFeedUpdater(ConfigDir, hostsFeeds, hostsRefresh)
+
+	metricsListen := ConfigKeyValues["metrics-listen"]
+	enablePprof := ConfigKeyValues["pprof"] == "on"
+	StartMetricsServer(metricsListen, enablePprof)
+
+	storeCurrentConfig(&MutableConfig{
+		ProxyStatus:      ProxyStatus,
+		WhitelistDomains: WhitelistDomains,
+		HostsCache:       loadHostsFiles(ConfigDir),
+		RelayerAddrs:     collectRelayerAddrs(allConfLines, ConfigKeyValues),
+	})
+	go WatchReload()
+
 	return err
 }
 
@@ -211,15 +331,104 @@ func exportKeyValues(keyValues *map[string]string, keys []string) string {
 	return result
 }
 
-// SetRelayer 设置relayer地址
+// SetRelayer 设置单个relayer地址
 func SetRelayer(remoteIpe string) {
+	setRelayerAddr(remoteIpe)
+	pool := CreateRelayerPool([]string{currentRemoteAddr()})
+	pool.SetHealthChangeCallback(syncActiveRelayerAddr)
+	replaceRelayerPool(pool)
+}
+
+// SetRelayers 由多个relayer地址构建一致性哈希relayer池
+// Pick()按目标域名哈希稳定地选出relayer，但目前只有RelayerAddrFor/
+// cmd.SelectedRelayerAddr()能观测到这个选择结果——comm.SendQueryReq/
+// Connect2Remote还不支持按地址拨号（见cmd/comm.go里的TODO），所以这还不是真正
+// 的按域名分发出站流量。这个函数眼下能落地的是failover：RemoteAddr/RemotePort
+// 初始化为第一个relayer，之后由syncActiveRelayerAddr跟随池的健康状态更新，
+// 第一个relayer挂掉时会切到池里下一个仍然存活的地址
+func SetRelayers(remoteIpes []string) {
+	if len(remoteIpes) > 0 {
+		setRelayerAddr(remoteIpes[0])
+	}
+	pool := CreateRelayerPool(remoteIpes)
+	pool.SetHealthChangeCallback(syncActiveRelayerAddr)
+	replaceRelayerPool(pool)
+	syncActiveRelayerAddr()
+}
+
+// replaceRelayerPool 换入新的relayer池并关闭旧池
+// CreateRelayerPool会启动一个常驻的probeLoop，每次(re)配置relayer都重新建池，
+// 若不Close旧池，其probeLoop goroutine会随着每次SIGHUP热重载无限累积
+func replaceRelayerPool(pool *RelayerPool) {
+	relayersMu.Lock()
+	old := Relayers
+	Relayers = pool
+	relayersMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// RelayerAddrFor 按目标域名从relayer池中一致性哈希选出relayer地址
+// 相同域名稳定落在同一个relayer上，有利于会话保持协议和remote DNS缓存的局部性。
+// 池为空（未启用多relayer）时退化为RemoteAddr/RemotePort，与历史行为一致。
+// Init()把它注入cmd.RelayerAddrForDomain，cmd.sendQuery据此选出relayer地址，
+// 但该地址目前只在cmd.SelectedRelayerAddr()里可观测——comm.SendQueryReq/
+// Connect2Remote还不接受按地址拨号，真正的出站连接仍然打到固定的那一个远端，
+// 见cmd/comm.go里的TODO
+func RelayerAddrFor(domain string) (string, error) {
+	pool := CurrentRelayerPool()
+	if pool == nil {
+		return currentRemoteAddr(), nil
+	}
+	r, err := pool.Pick(domain)
+	if err != nil {
+		return "", err
+	}
+	return r.HostPort(), nil
+}
+
+func setRelayerAddr(remoteIpe string) {
 	items := strings.Split(remoteIpe, ":")
-	RemoteAddr = strings.TrimSpace(items[0])
+	host := strings.TrimSpace(items[0])
+	port := "8080"
 	if len(items) >= 2 {
-		RemotePort = strings.TrimSpace(items[1])
-	} else {
-		RemotePort = "8080"
+		port = strings.TrimSpace(items[1])
 	}
+	remoteAddrMu.Lock()
+	RemoteAddr = host
+	RemotePort = port
+	remoteAddrMu.Unlock()
+}
+
+// collectRelayerAddrs 从配置中收集所有relayer地址
+// 支持重复出现的`relayer=`键，以及逗号分隔的`relayers=a,b,c`键
+func collectRelayerAddrs(allConfLines []string, keyValues map[string]string) []string {
+	var addrs []string
+	for _, line := range allConfLines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if strings.TrimSpace(kv[0]) != "relayer" {
+			continue
+		}
+		addr := strings.TrimSpace(kv[1])
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if relayers, ok := keyValues["relayers"]; ok {
+		for _, addr := range strings.Split(relayers, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
 }
 
 // SetListen 设定本地监听地址
@@ -237,6 +446,13 @@ func SetListen(localIpe string) {
 }
 
 func readHosts(configDir string) {
+	mergeHostsCache(loadHostsFiles(configDir))
+}
+
+// loadHostsFiles 读取configDir/hosts目录下的所有hosts文件并汇总为一个map
+// 与readHosts不同，它不直接写入全局hostsCache，
+// 因此也可以用来为热重载的MutableConfig构造一份独立的快照
+func loadHostsFiles(configDir string) map[string]string {
 	hostsDir := configDir + "/hosts"
 
 	hostsFiles := getHostsList(hostsDir)
@@ -249,16 +465,18 @@ func readHosts(configDir string) {
 		}
 	}
 
+	result := make(map[string]string)
 	for _, host := range hosts {
 		items := strings.Split(host, " ")
 		if len(items) >= 2 {
 			domain := strings.TrimSpace(items[0])
 			ip := strings.TrimSpace(items[1])
 			if domain != "" && ip != "" {
-				hostsCache[domain] = ip
+				result[domain] = ip
 			}
 		}
 	}
+	return result
 }
 
 func getHostsList(hostsDir string) []string {
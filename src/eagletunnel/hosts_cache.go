@@ -0,0 +1,22 @@
+package eagletunnel
+
+import "sync"
+
+// hostsCacheMu 保护hostsCache的读写
+// WatchReload（SIGHUP热重载）和hostsFeedUpdater（定时拉取远程hosts列表）是两个
+// 独立的长驻goroutine，都会并发写这个map；不加锁会被Go runtime判定为
+// fatal error: concurrent map writes，直接让整个进程崩溃
+var hostsCacheMu sync.Mutex
+
+// hostsCache 当前生效的域名->IP静态映射
+// 不要在别处直接读写这个map，一律通过mergeHostsCache
+var hostsCache = make(map[string]string)
+
+// mergeHostsCache 把一批新的域名->IP条目原子地合并进hostsCache
+func mergeHostsCache(entries map[string]string) {
+	hostsCacheMu.Lock()
+	defer hostsCacheMu.Unlock()
+	for domain, ip := range entries {
+		hostsCache[domain] = ip
+	}
+}
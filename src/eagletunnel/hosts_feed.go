@@ -0,0 +1,197 @@
+package eagletunnel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultHostsFeedRefresh hosts-refresh未配置时的默认刷新间隔
+const defaultHostsFeedRefresh = 6 * time.Hour
+
+// hostsFeedTimeout 单次拉取远程hosts列表的超时时间
+const hostsFeedTimeout = 15 * time.Second
+
+// HostsFeed 一个远程hosts列表订阅源
+// 格式为 hosts-feed=<url>|<sha256-hex>，sha256部分可省略（表示不校验签名）
+type HostsFeed struct {
+	URL       string
+	PinSHA256 string
+}
+
+// parseHostsFeed 解析单条 hosts-feed 配置值
+func parseHostsFeed(value string) HostsFeed {
+	parts := strings.SplitN(value, "|", 2)
+	feed := HostsFeed{URL: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		feed.PinSHA256 = strings.ToLower(strings.TrimSpace(parts[1]))
+	}
+	return feed
+}
+
+// collectHostsFeeds 从配置中收集所有hosts-feed订阅源
+// 支持重复出现的 hosts-feed=<url>|<sha256> 键（.conf格式），
+// 以及由toKeyValues翻译出的、以逗号分隔的"hosts-feed"键（YAML/JSON格式）
+func collectHostsFeeds(allConfLines []string, keyValues map[string]string) []HostsFeed {
+	var feeds []HostsFeed
+	for _, line := range allConfLines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "hosts-feed" {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		if value != "" {
+			feeds = append(feeds, parseHostsFeed(value))
+		}
+	}
+
+	if len(allConfLines) == 0 {
+		if joined, ok := keyValues["hosts-feed"]; ok {
+			for _, value := range strings.Split(joined, ",") {
+				value = strings.TrimSpace(value)
+				if value != "" {
+					feeds = append(feeds, parseHostsFeed(value))
+				}
+			}
+		}
+	}
+
+	return feeds
+}
+
+// parseHostsRefresh 解析 hosts-refresh=<duration> 配置，解析失败时回退到默认值
+func parseHostsRefresh(value string) time.Duration {
+	if value == "" {
+		return defaultHostsFeedRefresh
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return defaultHostsFeedRefresh
+	}
+	return d
+}
+
+// feedCachePath 每个订阅源在磁盘上的缓存文件路径，用于离线重启时恢复
+func feedCachePath(configDir string, feed HostsFeed) string {
+	sum := sha256.Sum256([]byte(feed.URL))
+	return fmt.Sprintf("%s/hosts/.feed-%s.cache", configDir, hex.EncodeToString(sum[:8]))
+}
+
+// hostsFeedUpdater 周期性拉取一组远程hosts列表，校验签名后合并进hostsCache
+// 校验失败或拉取失败时保留上一次的缓存不变
+type hostsFeedUpdater struct {
+	configDir string
+	feeds     []HostsFeed
+	interval  time.Duration
+
+	merged map[string]string
+}
+
+// StartHostsFeedUpdater 启动后台goroutine持续刷新远程hosts列表
+// 启动时先从磁盘缓存恢复一份旧结果，保证离线重启也有数据可用
+func StartHostsFeedUpdater(configDir string, feeds []HostsFeed, interval time.Duration) {
+	if len(feeds) == 0 {
+		return
+	}
+	u := &hostsFeedUpdater{configDir: configDir, feeds: feeds, interval: interval}
+	u.loadFromDisk()
+	go u.loop()
+}
+
+func (u *hostsFeedUpdater) loadFromDisk() {
+	for _, feed := range u.feeds {
+		data, err := ioutil.ReadFile(feedCachePath(u.configDir, feed))
+		if err != nil {
+			continue
+		}
+		u.mergeInto(parseHostsBody(string(data)))
+	}
+}
+
+func (u *hostsFeedUpdater) loop() {
+	u.refreshAll()
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.refreshAll()
+	}
+}
+
+func (u *hostsFeedUpdater) refreshAll() {
+	for _, feed := range u.feeds {
+		u.refreshOne(feed)
+	}
+}
+
+func (u *hostsFeedUpdater) refreshOne(feed HostsFeed) {
+	body, err := fetchHostsFeed(feed)
+	if err != nil {
+		fmt.Println("hosts-feed: failed to fetch ", feed.URL, ": ", err)
+		return
+	}
+
+	u.mergeInto(parseHostsBody(string(body)))
+	if err := ioutil.WriteFile(feedCachePath(u.configDir, feed), body, 0644); err != nil {
+		fmt.Println("hosts-feed: failed to persist cache for ", feed.URL, ": ", err)
+	}
+}
+
+// mergeInto 把新抓取到的条目合并进全局hostsCache
+// 实际写入经由mergeHostsCache的hostsCacheMu加锁，与WatchReload的热重载路径共用
+// 同一把锁，避免两个独立的后台goroutine并发写map
+func (u *hostsFeedUpdater) mergeInto(entries map[string]string) {
+	mergeHostsCache(entries)
+}
+
+// fetchHostsFeed 拉取远程hosts列表，若配置了sha256 pin则校验内容完整性
+// 校验失败时返回错误，调用方不应更新缓存
+func fetchHostsFeed(feed HostsFeed) ([]byte, error) {
+	client := http.Client{Timeout: hostsFeedTimeout}
+	resp, err := client.Get(feed.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hosts-feed: unexpected status %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if feed.PinSHA256 != "" {
+		sum := sha256.Sum256(body)
+		got := hex.EncodeToString(sum[:])
+		if got != feed.PinSHA256 {
+			return nil, fmt.Errorf("hosts-feed: sha256 mismatch for %s, got %s want %s",
+				feed.URL, got, feed.PinSHA256)
+		}
+	}
+	return body, nil
+}
+
+// parseHostsBody 把一份hosts文本解析成domain到ip的映射，格式与本地hosts文件相同
+func parseHostsBody(body string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Fields(line)
+		if len(items) >= 2 {
+			domain := strings.TrimSpace(items[0])
+			ip := strings.TrimSpace(items[1])
+			if domain != "" && ip != "" {
+				result[domain] = ip
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package eagletunnel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseHostsFeed(t *testing.T) {
+	cases := []struct {
+		value   string
+		wantURL string
+		wantPin string
+	}{
+		{"https://example.com/hosts.txt", "https://example.com/hosts.txt", ""},
+		{"https://example.com/hosts.txt|ABCDEF", "https://example.com/hosts.txt", "abcdef"},
+		{" https://example.com/hosts.txt | ABCDEF ", "https://example.com/hosts.txt", "abcdef"},
+	}
+	for _, c := range cases {
+		feed := parseHostsFeed(c.value)
+		if feed.URL != c.wantURL || feed.PinSHA256 != c.wantPin {
+			t.Errorf("parseHostsFeed(%q) = {%q, %q}, want {%q, %q}",
+				c.value, feed.URL, feed.PinSHA256, c.wantURL, c.wantPin)
+		}
+	}
+}
+
+func TestCollectHostsFeeds(t *testing.T) {
+	lines := []string{
+		"hosts-feed = https://a.example.com/hosts.txt|deadbeef",
+		"hosts-feed = https://b.example.com/hosts.txt",
+		"listen = 0.0.0.0:8080",
+	}
+	feeds := collectHostsFeeds(lines, nil)
+	if len(feeds) != 2 {
+		t.Fatalf("collectHostsFeeds: got %d feeds, want 2", len(feeds))
+	}
+	if feeds[0].URL != "https://a.example.com/hosts.txt" || feeds[0].PinSHA256 != "deadbeef" {
+		t.Errorf("unexpected first feed: %+v", feeds[0])
+	}
+	if feeds[1].URL != "https://b.example.com/hosts.txt" || feeds[1].PinSHA256 != "" {
+		t.Errorf("unexpected second feed: %+v", feeds[1])
+	}
+}
+
+func TestParseHostsRefresh(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"", defaultHostsFeedRefresh.String()},
+		{"bogus", defaultHostsFeedRefresh.String()},
+		{"0s", defaultHostsFeedRefresh.String()},
+		{"6h", "6h0m0s"},
+	}
+	for _, c := range cases {
+		if got := parseHostsRefresh(c.value).String(); got != c.want {
+			t.Errorf("parseHostsRefresh(%q) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestFetchHostsFeedRejectsPinMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("evil.example.com 6.6.6.6"))
+	}))
+	defer server.Close()
+
+	feed := HostsFeed{URL: server.URL, PinSHA256: "0000000000000000000000000000000000000000000000000000000000000000"}
+	if _, err := fetchHostsFeed(feed); err == nil {
+		t.Fatal("fetchHostsFeed: expected error on sha256 pin mismatch, got nil")
+	}
+}
+
+func TestFetchHostsFeedAcceptsMatchingPin(t *testing.T) {
+	const body = "good.example.com 1.1.1.1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte(body))
+	feed := HostsFeed{URL: server.URL, PinSHA256: hex.EncodeToString(sum[:])}
+
+	got, err := fetchHostsFeed(feed)
+	if err != nil {
+		t.Fatalf("fetchHostsFeed: unexpected error %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("fetchHostsFeed: got %q, want %q", got, body)
+	}
+}
+
+func TestHostsFeedUpdaterRefreshOneKeepsCacheOnPinMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("evil.example.com 6.6.6.6"))
+	}))
+	defer server.Close()
+
+	hostsCacheMu.Lock()
+	previous := hostsCache
+	hostsCache = make(map[string]string)
+	hostsCacheMu.Unlock()
+	defer func() {
+		hostsCacheMu.Lock()
+		hostsCache = previous
+		hostsCacheMu.Unlock()
+	}()
+
+	mergeHostsCache(map[string]string{"trusted.example.com": "9.9.9.9"})
+
+	feed := HostsFeed{URL: server.URL, PinSHA256: "deadbeef"}
+	u := &hostsFeedUpdater{configDir: t.TempDir(), feeds: []HostsFeed{feed}}
+	u.refreshOne(feed)
+
+	if ip, ok := hostsCache["trusted.example.com"]; !ok || ip != "9.9.9.9" {
+		t.Fatalf("hostsCache: previous entry lost after a rejected refresh, got %v", hostsCache["trusted.example.com"])
+	}
+	if _, ok := hostsCache["evil.example.com"]; ok {
+		t.Fatal("hostsCache: pin-mismatched feed entries should never be merged in")
+	}
+}
+
+func TestParseHostsBody(t *testing.T) {
+	body := "# comment\nexample.com 1.2.3.4\n\nbad-line\nfoo.com 5.6.7.8"
+	got := parseHostsBody(body)
+	if got["example.com"] != "1.2.3.4" || got["foo.com"] != "5.6.7.8" {
+		t.Fatalf("parseHostsBody returned unexpected map: %v", got)
+	}
+	if len(got) != 2 {
+		t.Fatalf("parseHostsBody: got %d entries, want 2: %v", len(got), got)
+	}
+}
@@ -0,0 +1,99 @@
+package eagletunnel
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// relayerRTT relayer池内各节点的最近一次探测RTT
+var relayerRTT = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eagletunnel_relayer_rtt_seconds",
+		Help: "latest health-check RTT observed for a relayer",
+	},
+	[]string{"relayer"},
+)
+
+// relayerSuccessTotal relayer探测/转发成功的累计次数
+var relayerSuccessTotal = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eagletunnel_relayer_success_total",
+		Help: "cumulative successful probes for a relayer",
+	},
+	[]string{"relayer"},
+)
+
+// relayerFailureTotal relayer探测/转发失败的累计次数
+var relayerFailureTotal = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eagletunnel_relayer_failure_total",
+		Help: "cumulative failed probes for a relayer",
+	},
+	[]string{"relayer"},
+)
+
+// relayerAlive relayer当前是否被认为存活（1为存活，0为dead）
+var relayerAlive = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eagletunnel_relayer_alive",
+		Help: "1 if the relayer currently passes health checks, 0 otherwise",
+	},
+	[]string{"relayer"},
+)
+
+func init() {
+	prometheus.MustRegister(relayerRTT, relayerSuccessTotal, relayerFailureTotal, relayerAlive)
+}
+
+// StartMetricsServer 在给定地址上启动Prometheus指标端点
+// enablePprof为true时额外在同一个listener下挂载net/http/pprof
+func StartMetricsServer(addr string, enablePprof bool) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	go exportRelayerStats()
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Println("metrics server stopped: ", err)
+		}
+	}()
+}
+
+// exportRelayerStats 周期性地把Relayers池的健康状态同步到Prometheus gauge
+func exportRelayerStats() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		pool := CurrentRelayerPool()
+		if pool == nil {
+			continue
+		}
+		for _, s := range pool.Stats() {
+			relayerRTT.WithLabelValues(s.Addr).Set(s.RTT.Seconds())
+			relayerSuccessTotal.WithLabelValues(s.Addr).Set(float64(s.SuccessCount))
+			relayerFailureTotal.WithLabelValues(s.Addr).Set(float64(s.FailureCount))
+			alive := 0.0
+			if s.Alive {
+				alive = 1.0
+			}
+			relayerAlive.WithLabelValues(s.Addr).Set(alive)
+		}
+	}
+}
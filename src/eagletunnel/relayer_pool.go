@@ -0,0 +1,296 @@
+package eagletunnel
+
+import (
+	"errors"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoAliveRelayer 连接池内没有存活的relayer可用
+var ErrNoAliveRelayer = errors.New("no alive relayer in pool")
+
+// relayerVirtualNodes 每个relayer在一致性哈希环上的虚拟节点数
+const relayerVirtualNodes = 160
+
+// relayerMaxFails 连续探测失败达到此值后，relayer被标记为dead
+const relayerMaxFails = 3
+
+// relayerProbeInterval 存活relayer的探测间隔
+const relayerProbeInterval = 10 * time.Second
+
+// relayerBackoffCap dead relayer重新探测的最大退避间隔
+const relayerBackoffCap = 2 * time.Minute
+
+// Relayer 代表relayer池中的一个上游节点及其健康状态
+type Relayer struct {
+	Addr string
+	Port string
+
+	mu        sync.Mutex
+	alive     bool
+	fails     int
+	backoff   time.Duration
+	nextProbe time.Time
+	rtt       time.Duration
+	success   uint64
+	failure   uint64
+}
+
+// HostPort relayer的host:port形式地址
+func (r *Relayer) HostPort() string {
+	return r.Addr + ":" + r.Port
+}
+
+// Stats relayer的可观测性统计快照，供Check命令展示
+type Stats struct {
+	Addr         string
+	Alive        bool
+	RTT          time.Duration
+	SuccessCount uint64
+	FailureCount uint64
+}
+
+func (r *Relayer) stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Stats{
+		Addr:         r.HostPort(),
+		Alive:        r.alive,
+		RTT:          r.rtt,
+		SuccessCount: r.success,
+		FailureCount: r.failure,
+	}
+}
+
+// markSuccess记录一次成功的探测，transitioned表示relayer是否从dead变回alive
+func (r *Relayer) markSuccess(rtt time.Duration) (transitioned bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transitioned = !r.alive
+	r.alive = true
+	r.fails = 0
+	r.backoff = 0
+	r.rtt = rtt
+	r.success++
+	return
+}
+
+// markFailure记录一次失败的探测，transitioned表示relayer是否刚刚从alive变成dead
+func (r *Relayer) markFailure() (transitioned bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failure++
+	r.fails++
+	wasAlive := r.alive
+	if r.fails >= relayerMaxFails {
+		r.alive = false
+		if r.backoff == 0 {
+			r.backoff = relayerProbeInterval
+		} else {
+			r.backoff *= 2
+			if r.backoff > relayerBackoffCap {
+				r.backoff = relayerBackoffCap
+			}
+		}
+		r.nextProbe = time.Now().Add(r.backoff)
+	}
+	return wasAlive && !r.alive
+}
+
+func (r *Relayer) dueForProbe() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.alive {
+		return true
+	}
+	return !time.Now().Before(r.nextProbe)
+}
+
+func (r *Relayer) isAlive() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.alive
+}
+
+// ringNode 一致性哈希环上的一个虚拟节点
+type ringNode struct {
+	hash    uint32
+	relayer *Relayer
+}
+
+// RelayerPool 一组上游relayer，按一致性哈希把目标域名稳定地分配到同一个relayer
+// 同时周期性地对所有relayer做存活探测，自动剔除/恢复节点
+type RelayerPool struct {
+	mu       sync.RWMutex
+	relayers []*Relayer
+	ring     []ringNode
+
+	onHealthChange func()
+
+	stop chan struct{}
+}
+
+// SetHealthChangeCallback 注册一个回调，在任意relayer的存活状态发生翻转
+// （alive<->dead）时异步调用。eagletunnel.SetRelayer(s)用它把RemoteAddr/RemotePort
+// 与池内仍然存活的relayer保持同步，这样"第一个relayer挂了"时依赖这两个包级
+// 变量的历史调用方也能跟着failover，而不是继续对着一个已确认挂掉的地址拨号
+func (p *RelayerPool) SetHealthChangeCallback(cb func()) {
+	p.mu.Lock()
+	p.onHealthChange = cb
+	p.mu.Unlock()
+}
+
+// ActiveAddr 返回池内按配置顺序第一个存活的relayer地址，没有存活节点时ok为false
+// 与Pick()的一致性哈希不同，它不关心具体域名，只关心"RemoteAddr/RemotePort该指向谁"
+func (p *RelayerPool) ActiveAddr() (addr string, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.relayers {
+		if r.isAlive() {
+			return r.HostPort(), true
+		}
+	}
+	return "", false
+}
+
+// Size 返回池内配置的relayer数量
+func (p *RelayerPool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.relayers)
+}
+
+// CreateRelayerPool 由一组"host:port"地址创建relayer池，并启动后台健康检查
+func CreateRelayerPool(addrs []string) *RelayerPool {
+	p := &RelayerPool{stop: make(chan struct{})}
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port := splitHostPort(addr)
+		r := &Relayer{Addr: host, Port: port, alive: true}
+		p.relayers = append(p.relayers, r)
+	}
+	p.rebuildRing()
+	go p.probeLoop()
+	return p
+}
+
+func splitHostPort(addr string) (host, port string) {
+	items := strings.Split(addr, ":")
+	host = strings.TrimSpace(items[0])
+	if len(items) >= 2 {
+		port = strings.TrimSpace(items[1])
+	} else {
+		port = "8080"
+	}
+	return
+}
+
+func (p *RelayerPool) rebuildRing() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ring := make([]ringNode, 0, len(p.relayers)*relayerVirtualNodes)
+	for _, r := range p.relayers {
+		for i := 0; i < relayerVirtualNodes; i++ {
+			key := r.HostPort() + "#" + strconv.Itoa(i)
+			ring = append(ring, ringNode{hash: crc32.ChecksumIEEE([]byte(key)), relayer: r})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.ring = ring
+}
+
+// Pick 按destination domain的一致性哈希挑选一个relayer
+// 若该relayer当前不可用，则沿环顺时针找下一个存活节点
+func (p *RelayerPool) Pick(domain string) (*Relayer, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.ring) == 0 {
+		return nil, ErrNoAliveRelayer
+	}
+
+	h := crc32.ChecksumIEEE([]byte(domain))
+	idx := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+	for i := 0; i < len(p.ring); i++ {
+		node := p.ring[(idx+i)%len(p.ring)]
+		if node.relayer.isAlive() {
+			return node.relayer, nil
+		}
+	}
+	return nil, ErrNoAliveRelayer
+}
+
+// Stats 返回池内每个relayer的健康状态快照，供Check命令展示
+func (p *RelayerPool) Stats() []Stats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := make([]Stats, 0, len(p.relayers))
+	for _, r := range p.relayers {
+		stats = append(stats, r.stats())
+	}
+	return stats
+}
+
+// Close 停止后台探测
+func (p *RelayerPool) Close() {
+	close(p.stop)
+}
+
+func (p *RelayerPool) probeLoop() {
+	ticker := time.NewTicker(relayerProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.RLock()
+			relayers := append([]*Relayer(nil), p.relayers...)
+			p.mu.RUnlock()
+			for _, r := range relayers {
+				if r.dueForProbe() {
+					go p.probe(r)
+				}
+			}
+		}
+	}
+}
+
+// probe 向relayer发送一次轻量的ET ping以检测存活
+func (p *RelayerPool) probe(r *Relayer) {
+	start := time.Now()
+	err := pingRelayer(r.HostPort())
+	var transitioned bool
+	if err != nil {
+		transitioned = r.markFailure()
+	} else {
+		transitioned = r.markSuccess(time.Since(start))
+	}
+	if transitioned {
+		p.mu.RLock()
+		cb := p.onHealthChange
+		p.mu.RUnlock()
+		if cb != nil {
+			cb()
+		}
+	}
+}
+
+// pingRelayer 建立一次TCP连接作为轻量的ET ping
+// 只验证relayer端口的可达性，不承载业务数据
+func pingRelayer(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
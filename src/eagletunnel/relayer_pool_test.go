@@ -0,0 +1,140 @@
+package eagletunnel
+
+import "testing"
+
+func TestRelayerPoolPickIsStable(t *testing.T) {
+	p := &RelayerPool{}
+	for _, addr := range []string{"a.example.com:8080", "b.example.com:8080", "c.example.com:8080"} {
+		p.relayers = append(p.relayers, &Relayer{Addr: addr, alive: true})
+	}
+	p.rebuildRing()
+
+	domains := []string{"foo.com", "bar.com", "baz.org", "qux.net"}
+	for _, domain := range domains {
+		first, err := p.Pick(domain)
+		if err != nil {
+			t.Fatalf("Pick(%q) returned error: %v", domain, err)
+		}
+		for i := 0; i < 10; i++ {
+			again, err := p.Pick(domain)
+			if err != nil {
+				t.Fatalf("Pick(%q) returned error: %v", domain, err)
+			}
+			if again != first {
+				t.Fatalf("Pick(%q) is not stable across repeated calls", domain)
+			}
+		}
+	}
+}
+
+func TestRelayerPoolPickSkipsDeadRelayers(t *testing.T) {
+	p := &RelayerPool{}
+	dead := &Relayer{Addr: "dead.example.com:8080", alive: false}
+	alive := &Relayer{Addr: "alive.example.com:8080", alive: true}
+	p.relayers = append(p.relayers, dead, alive)
+	p.rebuildRing()
+
+	for i := 0; i < 20; i++ {
+		r, err := p.Pick("whatever-domain.com")
+		if err != nil {
+			t.Fatalf("Pick returned error: %v", err)
+		}
+		if r == dead {
+			t.Fatalf("Pick returned a dead relayer")
+		}
+	}
+}
+
+func TestRelayerPoolPickNoAliveRelayer(t *testing.T) {
+	p := &RelayerPool{}
+	p.relayers = append(p.relayers, &Relayer{Addr: "dead.example.com:8080", alive: false})
+	p.rebuildRing()
+
+	if _, err := p.Pick("foo.com"); err != ErrNoAliveRelayer {
+		t.Fatalf("expected ErrNoAliveRelayer, got %v", err)
+	}
+}
+
+func TestRelayerPoolActiveAddr(t *testing.T) {
+	p := &RelayerPool{}
+	dead := &Relayer{Addr: "dead.example.com:8080", Port: "", alive: false}
+	alive := &Relayer{Addr: "alive.example.com:8080", Port: "", alive: true}
+	p.relayers = append(p.relayers, dead, alive)
+
+	addr, ok := p.ActiveAddr()
+	if !ok {
+		t.Fatal("ActiveAddr: expected an alive relayer to be found")
+	}
+	if addr != alive.HostPort() {
+		t.Fatalf("ActiveAddr: got %q, want %q", addr, alive.HostPort())
+	}
+}
+
+func TestRelayerPoolActiveAddrNoAliveRelayer(t *testing.T) {
+	p := &RelayerPool{}
+	p.relayers = append(p.relayers, &Relayer{Addr: "dead.example.com:8080", alive: false})
+
+	if _, ok := p.ActiveAddr(); ok {
+		t.Fatal("ActiveAddr: expected ok=false when no relayer is alive")
+	}
+}
+
+func TestRelayerMarkFailureAndSuccessReportTransitions(t *testing.T) {
+	r := &Relayer{Addr: "flaky.example.com:8080", alive: true}
+
+	for i := 0; i < relayerMaxFails-1; i++ {
+		if transitioned := r.markFailure(); transitioned {
+			t.Fatalf("markFailure: unexpected transition on failure %d", i+1)
+		}
+	}
+	if transitioned := r.markFailure(); !transitioned {
+		t.Fatal("markFailure: expected a transition once relayerMaxFails is reached")
+	}
+
+	if transitioned := r.markSuccess(0); !transitioned {
+		t.Fatal("markSuccess: expected a transition back to alive")
+	}
+	if transitioned := r.markSuccess(0); transitioned {
+		t.Fatal("markSuccess: unexpected transition on an already-alive relayer")
+	}
+}
+
+func TestRelayerPoolProbeFiresHealthChangeCallbackOnTransition(t *testing.T) {
+	p := &RelayerPool{}
+	r := &Relayer{Addr: "127.0.0.1", Port: "1", alive: true}
+	p.relayers = append(p.relayers, r)
+
+	calls := 0
+	p.SetHealthChangeCallback(func() { calls++ })
+
+	for i := 0; i < relayerMaxFails; i++ {
+		p.probe(r)
+	}
+	if calls != 1 {
+		t.Fatalf("expected health-change callback to fire exactly once, got %d calls", calls)
+	}
+	if r.isAlive() {
+		t.Fatal("expected relayer to be marked dead after relayerMaxFails consecutive probe failures")
+	}
+}
+
+func TestCollectRelayerAddrs(t *testing.T) {
+	lines := []string{
+		"relayer = a.example.com:8080",
+		"relayer = b.example.com:8080",
+		"listen = 0.0.0.0:8080",
+	}
+	keyValues := map[string]string{"relayers": "c.example.com:8080, d.example.com:8080"}
+
+	got := collectRelayerAddrs(lines, keyValues)
+	want := []string{"a.example.com:8080", "b.example.com:8080", "c.example.com:8080", "d.example.com:8080"}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, addr := range want {
+		if got[i] != addr {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}